@@ -0,0 +1,93 @@
+// Package convert adapts PCM byte streams between oto's supported sample
+// formats, so the rest of the synth can synthesize in a single format
+// (float32) and convert once at the sink.
+package convert
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Float32BytesReaderFromInt16BytesReader wraps src, which emits signed
+// 16-bit little-endian PCM, converting each sample to 32-bit little-endian
+// IEEE float PCM as it is read.
+func Float32BytesReaderFromInt16BytesReader(src io.Reader) io.Reader {
+	return newReader(src, 2, 4, int16ToFloat32)
+}
+
+// Int16BytesReaderFromFloat32BytesReader is the reverse of
+// Float32BytesReaderFromInt16BytesReader.
+func Int16BytesReaderFromFloat32BytesReader(src io.Reader) io.Reader {
+	return newReader(src, 4, 2, float32ToInt16)
+}
+
+// Uint8BytesReaderFromFloat32BytesReader converts 32-bit float PCM to
+// unsigned 8-bit PCM, oto's third sink format.
+func Uint8BytesReaderFromFloat32BytesReader(src io.Reader) io.Reader {
+	return newReader(src, 4, 1, float32ToUint8)
+}
+
+func int16ToFloat32(in []byte) []byte {
+	v := int16(binary.LittleEndian.Uint16(in))
+	out := make([]byte, 4)
+	binary.LittleEndian.PutUint32(out, math.Float32bits(float32(v)/32768))
+	return out
+}
+
+func float32ToInt16(in []byte) []byte {
+	f := math.Float32frombits(binary.LittleEndian.Uint32(in))
+	out := make([]byte, 2)
+	binary.LittleEndian.PutUint16(out, uint16(int16(f*32767)))
+	return out
+}
+
+func float32ToUint8(in []byte) []byte {
+	f := math.Float32frombits(binary.LittleEndian.Uint32(in))
+	return []byte{byte(int(f*127) + 128)}
+}
+
+// sampleConverter converts one input sample's raw bytes to one output
+// sample's raw bytes.
+type sampleConverter func(in []byte) []byte
+
+// reader re-chunks src's byte stream from inSize-byte samples to
+// outSize-byte samples via convert, buffering any output that didn't fit
+// in the caller's buf until the next Read.
+type reader struct {
+	src       io.Reader
+	inSize    int
+	outSize   int
+	convert   sampleConverter
+	remaining []byte
+}
+
+func newReader(src io.Reader, inSize, outSize int, convert sampleConverter) *reader {
+	return &reader{src: src, inSize: inSize, outSize: outSize, convert: convert}
+}
+
+func (r *reader) Read(buf []byte) (int, error) {
+	if len(r.remaining) > 0 {
+		n := copy(buf, r.remaining)
+		r.remaining = r.remaining[n:]
+		return n, nil
+	}
+
+	numSamples := len(buf) / r.outSize
+	if numSamples == 0 {
+		numSamples = 1
+	}
+	in := make([]byte, numSamples*r.inSize)
+	n, err := r.src.Read(in)
+
+	out := make([]byte, 0, (n/r.inSize)*r.outSize)
+	for i := 0; i+r.inSize <= n; i += r.inSize {
+		out = append(out, r.convert(in[i:i+r.inSize])...)
+	}
+
+	copied := copy(buf, out)
+	if copied < len(out) {
+		r.remaining = out[copied:]
+	}
+	return copied, err
+}
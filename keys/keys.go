@@ -1,14 +1,18 @@
 package keys
 
 import (
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
 	"math"
-	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"keyboard/keys/convert"
+	"keyboard/keys/recorder"
+
 	"github.com/ebitengine/oto/v3"
 )
 
@@ -16,126 +20,325 @@ var (
 	sampleRate   = flag.Int("samplerate", 44100, "sample rate")
 	channelCount = flag.Int("channelcount", 10, "number of channel")
 	format       = flag.String("format", "s16le", "source format (u8, s16le, or f32le)")
-	NoteCount    = 0 // Exported global variable
 )
 
-type SineWave struct {
-	freq   float64
-	length int64
-	pos    int64
+// Envelope describes an ADSR amplitude shape in wall-clock time. Attack,
+// Decay and Release are the lengths of their respective ramps; Sustain is
+// how long a note holds at SustainLevel before it is considered "held" and
+// simply stays there until NoteOff is called.
+type Envelope struct {
+	Attack       time.Duration
+	Decay        time.Duration
+	Sustain      time.Duration
+	Release      time.Duration
+	SustainLevel float64
+}
 
-	channelCount int
-	format       oto.Format
+// DefaultEnvelope is used for every voice the Mixer creates.
+var DefaultEnvelope = Envelope{
+	Attack:       10 * time.Millisecond,
+	Decay:        50 * time.Millisecond,
+	Sustain:      3 * time.Second,
+	Release:      300 * time.Millisecond,
+	SustainLevel: 0.6,
+}
 
-	remaining []byte
+func durationSamples(d time.Duration) int64 {
+	return int64(d) * int64(*sampleRate) / int64(time.Second)
 }
 
-func formatByteLength(format oto.Format) int {
-	switch format {
-	case oto.FormatFloat32LE:
-		return 4
-	case oto.FormatUnsignedInt8:
-		return 1
-	case oto.FormatSignedInt16LE:
-		return 2
-	default:
-		panic(fmt.Sprintf("unexpected format: %d", format))
-	}
+func (e Envelope) attackSamples() int64  { return durationSamples(e.Attack) }
+func (e Envelope) decaySamples() int64   { return durationSamples(e.Decay) }
+func (e Envelope) releaseSamples() int64 { return durationSamples(e.Release) }
+
+// Float32Source produces interleaved float32 PCM samples in [-1, 1], one
+// value per (frame, channel) pair. It is the common internal format every
+// oscillator synthesizes in; per-sink conversion happens once, at the
+// boundary where a Float32Source is turned into an io.Reader for oto (see
+// Sink).
+type Float32Source interface {
+	ReadFloat32(buf []float32) (int, error)
+}
+
+// Voice is a single playing note: an Oscillator shaped by an ADSR
+// envelope. NewSineWave, NewSquareWave, NewSawWave and NewTriangleWave all
+// return a Voice with a different Oscillator, so adding a new timbre never
+// touches the envelope logic below.
+type Voice struct {
+	osc          Oscillator
+	freq         float64
+	velocity     float64
+	channelCount int
+	pos          int64 // samples generated so far
+
+	env            Envelope
+	releasedAt     int64 // s.pos at the moment NoteOff was called, -1 until then
+	levelAtRelease float64
+	done           bool
 }
 
-func NewSineWave(freq float64, duration time.Duration, channelCount int, format oto.Format) *SineWave {
-	l := int64(channelCount) * int64(formatByteLength(format)) * int64(*sampleRate) * int64(duration) / int64(time.Second)
-	l = l / 4 * 4
-	return &SineWave{
+// NewVoice creates a Voice rendering osc's waveform at freq through env.
+func NewVoice(osc Oscillator, freq float64, velocity float64, channelCount int, env Envelope) *Voice {
+	return &Voice{
+		osc:          osc,
 		freq:         freq,
-		length:       l,
+		velocity:     velocity,
 		channelCount: channelCount,
-		format:       format,
+		env:          env,
+		releasedAt:   -1,
 	}
 }
 
-func (s *SineWave) Read(buf []byte) (int, error) {
-	if len(s.remaining) > 0 {
-		n := copy(buf, s.remaining)
-		copy(s.remaining, s.remaining[n:])
-		s.remaining = s.remaining[:len(s.remaining)-n]
-		return n, nil
+// NewSineWave creates a sine-wave Voice.
+func NewSineWave(freq float64, velocity float64, channelCount int, env Envelope) *Voice {
+	return NewVoice(SineOsc{}, freq, velocity, channelCount, env)
+}
+
+// NewSquareWave creates a square-wave Voice.
+func NewSquareWave(freq float64, velocity float64, channelCount int, env Envelope) *Voice {
+	return NewVoice(SquareOsc{}, freq, velocity, channelCount, env)
+}
+
+// NewSawWave creates a sawtooth-wave Voice.
+func NewSawWave(freq float64, velocity float64, channelCount int, env Envelope) *Voice {
+	return NewVoice(SawOsc{}, freq, velocity, channelCount, env)
+}
+
+// NewTriangleWave creates a triangle-wave Voice.
+func NewTriangleWave(freq float64, velocity float64, channelCount int, env Envelope) *Voice {
+	return NewVoice(TriangleOsc{}, freq, velocity, channelCount, env)
+}
+
+// NoteOff transitions the envelope from wherever it currently is (attack,
+// decay, or sustain) into the release phase. It is a no-op if called more
+// than once. ReadFloat32 returns io.EOF once the release phase has
+// finished.
+func (s *Voice) NoteOff() {
+	if s.releasedAt >= 0 {
+		return
+	}
+	amp, _ := s.amplitude()
+	s.releasedAt = s.pos
+	s.levelAtRelease = amp
+}
+
+// amplitude returns the envelope value at the current sample position, and
+// whether the envelope has completed (release has fully decayed to zero).
+func (s *Voice) amplitude() (float64, bool) {
+	if s.releasedAt < 0 {
+		a := s.env.attackSamples()
+		d := s.env.decaySamples()
+		switch {
+		case s.pos < a:
+			if a == 0 {
+				return 1, false
+			}
+			return float64(s.pos) / float64(a), false
+		case s.pos < a+d:
+			if d == 0 {
+				return s.env.SustainLevel, false
+			}
+			t := float64(s.pos-a) / float64(d)
+			return 1 - t*(1-s.env.SustainLevel), false
+		default:
+			return s.env.SustainLevel, false
+		}
 	}
 
-	if s.pos == s.length {
-		return 0, io.EOF
+	r := s.env.releaseSamples()
+	elapsed := s.pos - s.releasedAt
+	if r == 0 || elapsed >= r {
+		return 0, true
 	}
+	return s.levelAtRelease * (1 - float64(elapsed)/float64(r)), false
+}
+
+// ReadFloat32 fills buf with this voice's envelope-scaled oscillator
+// samples, duplicated across s.channelCount channels, and returns io.EOF
+// once the release phase has fully decayed to zero.
+func (s *Voice) ReadFloat32(buf []float32) (int, error) {
+	length := float64(*sampleRate) / s.freq
+
+	n := 0
+	for n+s.channelCount <= len(buf) {
+		amp, eof := s.amplitude()
+		if eof {
+			s.done = true
+			break
+		}
 
-	eof := false
-	if s.pos+int64(len(buf)) > s.length {
-		buf = buf[:s.length-s.pos]
-		eof = true
+		phase := math.Mod(float64(s.pos)/length, 1)
+		v := float32(s.osc.At(phase) * 0.3 * amp * s.velocity)
+		for ch := 0; ch < s.channelCount; ch++ {
+			buf[n+ch] = v
+		}
+
+		s.pos++
+		n += s.channelCount
 	}
 
-	var origBuf []byte
-	if len(buf)%4 > 0 {
-		origBuf = buf
-		buf = make([]byte, len(origBuf)+4-len(origBuf)%4)
+	if s.done {
+		return n, io.EOF
 	}
+	return n, nil
+}
 
-	length := float64(*sampleRate) / float64(s.freq)
+// float32BytesReader adapts a Float32Source to an io.Reader of raw
+// little-endian float32 PCM bytes, the one format every other sink format
+// is converted from.
+type float32BytesReader struct {
+	src Float32Source
+}
 
-	num := formatByteLength(s.format) * s.channelCount
-	p := s.pos / int64(num)
-	switch s.format {
+func (r *float32BytesReader) Read(buf []byte) (int, error) {
+	samples := make([]float32, len(buf)/4)
+	n, err := r.src.ReadFloat32(samples)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint32(buf[4*i:4*i+4], math.Float32bits(samples[i]))
+	}
+	return n * 4, err
+}
+
+// Sink converts src's internal float32 PCM to oto's on-the-wire format,
+// doing so exactly once at this boundary rather than in every oscillator.
+func Sink(src Float32Source, format oto.Format) io.Reader {
+	f32 := &float32BytesReader{src: src}
+	switch format {
 	case oto.FormatFloat32LE:
-		for i := 0; i < len(buf)/num; i++ {
-			bs := math.Float32bits(float32(math.Sin(2*math.Pi*float64(p)/length) * 0.3))
-			for ch := 0; ch < *channelCount; ch++ {
-				buf[num*i+4*ch] = byte(bs)
-				buf[num*i+1+4*ch] = byte(bs >> 8)
-				buf[num*i+2+4*ch] = byte(bs >> 16)
-				buf[num*i+3+4*ch] = byte(bs >> 24)
-			}
-			p++
-		}
+		return f32
+	case oto.FormatSignedInt16LE:
+		return convert.Int16BytesReaderFromFloat32BytesReader(f32)
 	case oto.FormatUnsignedInt8:
-		for i := 0; i < len(buf)/num; i++ {
-			const max = 127
-			b := int(math.Sin(2*math.Pi*float64(p)/length) * 0.3 * max)
-			for ch := 0; ch < *channelCount; ch++ {
-				buf[num*i+ch] = byte(b + 128)
-			}
-			p++
+		return convert.Uint8BytesReaderFromFloat32BytesReader(f32)
+	default:
+		panic(fmt.Sprintf("unexpected format: %d", format))
+	}
+}
+
+const mixerVoices = 32
+
+// Mixer is a fixed pool of mixerVoices Voices summed into a single float32
+// stream. A single oto.Player reads from it for the whole program's
+// lifetime, so playing a note is just flipping a voice on or off rather
+// than allocating a new oto.Player per keypress (which leaked players and
+// tripped oto's "a same source is used by multiple Player" check once
+// enough notes had been played).
+type Mixer struct {
+	channelCount int
+	env          Envelope
+
+	// Oscillator is the waveform every new voice is given. It defaults to
+	// SineOsc{} and may be changed at any time; only notes started after
+	// the change pick up the new waveform.
+	Oscillator Oscillator
+
+	mu      sync.Mutex
+	voices  [mixerVoices]*Voice
+	scratch []float32
+
+	// framesPlayed is the number of frames handed back by ReadFloat32 so
+	// far. It's the Mixer's own notion of "now", for callers (such as a
+	// seq.Sequencer) that need to schedule against actual audio progress
+	// rather than assume wall-clock time tracks the audio callback.
+	framesPlayed atomic.Int64
+}
+
+// NewMixer creates a Mixer whose voices use env and render audio for
+// channelCount channels.
+func NewMixer(channelCount int, env Envelope) *Mixer {
+	return &Mixer{channelCount: channelCount, env: env, Oscillator: SineOsc{}}
+}
+
+// NoteOn starts playing freq at velocity (0-1) on the first free voice. If
+// every voice is in use, the first voice is stolen.
+func (m *Mixer) NoteOn(freq, velocity float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	steal := 0
+	for i, v := range m.voices {
+		if v == nil || v.done {
+			steal = i
+			break
 		}
-	case oto.FormatSignedInt16LE:
-		for i := 0; i < len(buf)/num; i++ {
-			const max = 32767
-			b := int16(math.Sin(2*math.Pi*float64(p)/length) * 0.3 * max)
-			for ch := 0; ch < *channelCount; ch++ {
-				buf[num*i+2*ch] = byte(b)
-				buf[num*i+1+2*ch] = byte(b >> 8)
-			}
-			p++
+	}
+	m.voices[steal] = NewVoice(m.Oscillator, freq, velocity, m.channelCount, m.env)
+}
+
+// NoteOff releases every active voice currently playing freq, letting it
+// ring out through the envelope's Release phase.
+func (m *Mixer) NoteOff(freq float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range m.voices {
+		if v != nil && !v.done && v.freq == freq {
+			v.NoteOff()
 		}
 	}
+}
 
-	s.pos += int64(len(buf))
+// ReadFloat32 sums every active voice into buf and soft-clips the mix so
+// overlapping notes can't push it past full scale. It never returns
+// io.EOF: a silent Mixer just emits zeroes.
+func (m *Mixer) ReadFloat32(buf []float32) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	n := len(buf)
-	if origBuf != nil {
-		n = copy(origBuf, buf)
-		s.remaining = buf[n:]
+	for i := range buf {
+		buf[i] = 0
 	}
 
-	if eof {
-		return n, io.EOF
+	if cap(m.scratch) < len(buf) {
+		m.scratch = make([]float32, len(buf))
 	}
-	return n, nil
+	scratch := m.scratch[:len(buf)]
+
+	for i, v := range m.voices {
+		if v == nil {
+			continue
+		}
+		n, err := v.ReadFloat32(scratch)
+		for j := 0; j < n; j++ {
+			buf[j] += scratch[j]
+		}
+		if err == io.EOF {
+			m.voices[i] = nil
+		}
+	}
+
+	for i, v := range buf {
+		buf[i] = softClip(v)
+	}
+	m.framesPlayed.Add(int64(len(buf) / m.channelCount))
+	return len(buf), nil
 }
 
-func play(context *oto.Context, freq float64, duration time.Duration, channelCount int, format oto.Format) *oto.Player {
-	p := context.NewPlayer(NewSineWave(freq, duration, channelCount, format))
-	p.Play()
-	return p
+// FramesPlayed returns how many frames this Mixer has handed back so far.
+func (m *Mixer) FramesPlayed() int64 {
+	return m.framesPlayed.Load()
+}
+
+// softClip maps (-inf, inf) to (-1, 1), leaving quiet signals untouched
+// and rounding off peaks instead of hard-clipping them.
+func softClip(x float32) float32 {
+	return x / (1 + float32(math.Abs(float64(x))))
 }
 
-func InitAudioContext() (*oto.Context, *oto.NewContextOptions, error) {
+// AudioContext wraps an *oto.Context together with the options it was
+// created with. It drives playback through a single long-lived Mixer and
+// oto.Player, and can optionally tee that player's output into a
+// recorder.Writer so everything played is captured to disk.
+type AudioContext struct {
+	*oto.Context
+	op    *oto.NewContextOptions
+	mixer *Mixer
+
+	mu  sync.Mutex
+	rec *recorder.Writer
+}
+
+func InitAudioContext() (*AudioContext, error) {
 	op := &oto.NewContextOptions{}
 	op.SampleRate = *sampleRate
 	op.ChannelCount = *channelCount
@@ -148,81 +351,150 @@ func InitAudioContext() (*oto.Context, *oto.NewContextOptions, error) {
 	case "s16le":
 		op.Format = oto.FormatSignedInt16LE
 	default:
-		return nil, nil, fmt.Errorf("format must be u8, s16le, or f32le but: %s", *format)
+		return nil, fmt.Errorf("format must be u8, s16le, or f32le but: %s", *format)
 	}
 
 	c, ready, err := oto.NewContext(op)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	<-ready
-	return c, op, nil
-}
-
-var noteFrequencies = map[string]float64{
-	"q": 523.25,  // C5
-	"2": 554.37,  // C#5
-	"w": 587.33,  // D5
-	"3": 622.25,  // D#5
-	"e": 659.25,  // E5
-	"4": 698.46,  // F5
-	"r": 739.99,  // F#5
-	"5": 783.99,  // G5
-	"t": 830.61,  // G#5
-	"6": 880.00,  // A5
-	"y": 932.33,  // A#5
-	"7": 987.77,  // B5
-	"u": 1046.50, // C6
-	"8": 1108.73, // C#6
-	"i": 1174.66, // D6
-	"9": 1244.51, // D#6
-	"o": 1318.51,
-	"z": 261.63, // C4
-	"s": 277.18, // C#4
-	"x": 293.66, // D4
-	"d": 311.13, // D#4
-	"c": 329.63, // E4
-	"f": 349.23, // F4
-	"v": 369.99, // F#4
-	"g": 392.00, // G4
-	"b": 415.30, // G#4
-	"h": 440.00, // A4
-	"n": 466.16, // A#4
-	"j": 493.88, // B4
-}
-
-func Run(key rune, c *oto.Context, op *oto.NewContextOptions) error {
-	var wg sync.WaitGroup
-	var players []*oto.Player
-	var m sync.Mutex
-
-	// Map keys to corresponding frequencies
-	keyStr := string(key)
-	if freq, ok := noteFrequencies[keyStr]; ok {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			p := play(c, freq, 3*time.Second, op.ChannelCount, op.Format)
-			var initialVolume float64 = 1 / float64(NoteCount)
-
-			p.SetVolume(initialVolume)
-			time.Sleep(1 * time.Second)
-			p.SetVolume(initialVolume / 2)
-			time.Sleep(1 * time.Second)
-			p.SetVolume(initialVolume / 3)
-			time.Sleep(50000)
-			p.SetVolume(0.0)
-
-			m.Lock()
-			players = append(players, p)
-			m.Unlock()
-			NoteCount--
-		}()
-
-		wg.Wait()
-		// Pin the players not to GC the players.
-		runtime.KeepAlive(players)
+
+	a := &AudioContext{Context: c, op: op, mixer: NewMixer(op.ChannelCount, DefaultEnvelope)}
+	p := c.NewPlayer(&recordingSource{a: a, src: Sink(a.mixer, op.Format)})
+	p.Play()
+	return a, nil
+}
+
+// NoteOn starts playing freq at velocity (0-1) through this context's
+// Mixer.
+func (a *AudioContext) NoteOn(freq, velocity float64) {
+	a.mixer.NoteOn(freq, velocity)
+}
+
+// NoteOff releases every voice currently playing freq.
+func (a *AudioContext) NoteOff(freq float64) {
+	a.mixer.NoteOff(freq)
+}
+
+// SampleRate returns the sample rate this context was opened with, so
+// callers driving playback from sample-accurate timing (such as a
+// sequencer) don't need to duplicate the -samplerate flag.
+func (a *AudioContext) SampleRate() int {
+	return a.op.SampleRate
+}
+
+// FramesPlayed returns how many frames this context's Mixer has handed to
+// oto so far, for callers that need to schedule against actual audio
+// progress instead of wall-clock time.
+func (a *AudioContext) FramesPlayed() int64 {
+	return a.mixer.FramesPlayed()
+}
+
+// SetOscillator changes the waveform new notes are voiced with. Notes
+// already playing keep whatever oscillator they started with.
+func (a *AudioContext) SetOscillator(osc Oscillator) {
+	a.mixer.Oscillator = osc
+}
+
+// recordingSource reads from src, tee'd through whichever recorder.Writer
+// is currently active via RecordTo. Unlike a plain Writer.Tee, the
+// recorder it tees into can come and go across the lifetime of this
+// reader, since RecordTo/StopRecording may be called at any point after
+// the single long-lived oto.Player has already started reading from it.
+type recordingSource struct {
+	a   *AudioContext
+	src io.Reader
+}
+
+func (r *recordingSource) Read(buf []byte) (int, error) {
+	// a.mu is held for the whole read, so StopRecording can't take and
+	// Close the recorder while this read is still writing into it.
+	r.a.mu.Lock()
+	defer r.a.mu.Unlock()
+
+	if r.a.rec == nil {
+		return r.src.Read(buf)
 	}
+	return r.a.rec.Tee(r.src).Read(buf)
+}
 
+// RecordTo tees every note played from now on into w as a WAV file,
+// matching the sample rate, channel count and sample format this context
+// was opened with. Call StopRecording to patch the header's final sizes.
+func (a *AudioContext) RecordTo(w io.WriteSeeker) error {
+	var sampleFormat recorder.SampleFormat
+	switch a.op.Format {
+	case oto.FormatFloat32LE:
+		sampleFormat = recorder.SampleFloat32
+	case oto.FormatUnsignedInt8:
+		sampleFormat = recorder.SampleUint8
+	default:
+		sampleFormat = recorder.SampleInt16
+	}
+
+	rec, err := recorder.New(w, recorder.FormatWAV, sampleFormat, a.op.SampleRate, a.op.ChannelCount)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.rec = rec
+	a.mu.Unlock()
 	return nil
 }
+
+// StopRecording patches the header written by RecordTo with its final
+// size fields. It is a no-op if RecordTo was never called.
+func (a *AudioContext) StopRecording() error {
+	a.mu.Lock()
+	rec := a.rec
+	a.rec = nil
+	a.mu.Unlock()
+
+	if rec == nil {
+		return nil
+	}
+	return rec.Close()
+}
+
+// KeyNoteNumbers translates the terminal QWERTY layout into the same MIDI
+// note-number space a MIDI controller reports, so both input sources feed
+// the same Mixer identically.
+var KeyNoteNumbers = map[string]int{
+	"z": 60, // C4
+	"s": 61, // C#4
+	"x": 62, // D4
+	"d": 63, // D#4
+	"c": 64, // E4
+	"f": 65, // F4
+	"v": 66, // F#4
+	"g": 67, // G4
+	"b": 68, // G#4
+	"h": 69, // A4
+	"n": 70, // A#4
+	"j": 71, // B4
+	"q": 72, // C5
+	"2": 73, // C#5
+	"w": 74, // D5
+	"3": 75, // D#5
+	"e": 76, // E5
+	"4": 77, // F5
+	"r": 78, // F#5
+	"5": 79, // G5
+	"t": 80, // G#5
+	"6": 81, // A5
+	"y": 82, // A#5
+	"7": 83, // B5
+	"u": 84, // C6
+	"8": 85, // C#6
+	"i": 86, // D6
+	"9": 87, // D#6
+	"o": 88, // E6
+}
+
+// NoteNumberToFreq converts a MIDI note number to its frequency in Hz,
+// using A4 (note 69) as 440Hz.
+func NoteNumberToFreq(noteNumber int) float64 {
+	return 440 * math.Pow(2, float64(noteNumber-69)/12)
+}
@@ -0,0 +1,95 @@
+// Package midi reads note-on/note-off messages from a MIDI input device
+// and republishes them as NoteOn events carrying the same
+// (note number, velocity, gate) shape the terminal keyboard source
+// produces, so AudioContext.NoteOn/NoteOff can't tell the two apart.
+package midi
+
+import (
+	"fmt"
+
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/drivers"
+	_ "gitlab.com/gomidi/midi/v2/drivers/rtmididrv"
+)
+
+// NoteOn is emitted for every MIDI note-on message received from the
+// device. Gate is closed once the matching note-off (or a note-on with
+// velocity 0, which MIDI treats the same way) arrives.
+type NoteOn struct {
+	Note     int
+	Velocity float64
+	Gate     <-chan struct{}
+}
+
+// Source listens on a single MIDI input device until Close is called.
+type Source struct {
+	stop func()
+}
+
+// Devices lists the available MIDI input devices as "id: name" pairs,
+// suitable for printing alongside the -midi-device flag.
+func Devices() []string {
+	var names []string
+	for _, in := range midi.GetInPorts() {
+		names = append(names, fmt.Sprintf("%d: %s", in.Number(), in))
+	}
+	return names
+}
+
+// Open opens MIDI input device deviceID and starts listening. Events are
+// delivered on the returned channel until the Source is closed.
+func Open(deviceID int) (*Source, <-chan NoteOn, error) {
+	var in drivers.In
+	for _, candidate := range midi.GetInPorts() {
+		if candidate.Number() == deviceID {
+			in = candidate
+			break
+		}
+	}
+	if in == nil {
+		return nil, nil, fmt.Errorf("midi: no input device with id %d", deviceID)
+	}
+
+	events := make(chan NoteOn)
+	gates := map[int]chan struct{}{}
+
+	noteOff := func(key uint8) {
+		if gate, ok := gates[int(key)]; ok {
+			close(gate)
+			delete(gates, int(key))
+		}
+	}
+
+	stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
+		var ch, key, vel uint8
+		switch {
+		case msg.GetNoteOn(&ch, &key, &vel) && vel > 0:
+			// A retrigger before the previous note-off arrives would
+			// otherwise overwrite gates[key] and leave the earlier
+			// goroutine blocked forever on a gate nothing will close.
+			noteOff(key)
+			gate := make(chan struct{})
+			gates[int(key)] = gate
+			events <- NoteOn{
+				Note:     int(key),
+				Velocity: float64(vel) / 127,
+				Gate:     gate,
+			}
+		case msg.GetNoteOn(&ch, &key, &vel):
+			noteOff(key)
+		case msg.GetNoteOff(&ch, &key, &vel):
+			noteOff(key)
+		}
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("midi: listen: %w", err)
+	}
+
+	return &Source{stop: stop}, events, nil
+}
+
+// Close stops listening and releases the MIDI input device.
+func (s *Source) Close() error {
+	s.stop()
+	return nil
+}
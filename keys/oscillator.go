@@ -0,0 +1,71 @@
+package keys
+
+import "math"
+
+// Oscillator computes a waveform's value at a given phase, where phase is
+// the fraction of a cycle completed, wrapping in [0, 1). Every Voice
+// (from NewSineWave, NewSquareWave, ...) delegates its raw waveform shape to one of
+// these, so adding a new timbre never touches the envelope or ADSR logic.
+type Oscillator interface {
+	At(phase float64) float64
+}
+
+// SineOsc is a pure sine wave.
+type SineOsc struct{}
+
+func (SineOsc) At(phase float64) float64 { return math.Sin(2 * math.Pi * phase) }
+
+// SquareOsc alternates between +1 and -1 at the half cycle.
+type SquareOsc struct{}
+
+func (SquareOsc) At(phase float64) float64 {
+	if phase < 0.5 {
+		return 1
+	}
+	return -1
+}
+
+// SawOsc ramps linearly from -1 to 1 across a cycle.
+type SawOsc struct{}
+
+func (SawOsc) At(phase float64) float64 { return 2*phase - 1 }
+
+// TriangleOsc ramps linearly from -1 to 1 and back across a cycle.
+type TriangleOsc struct{}
+
+func (TriangleOsc) At(phase float64) float64 {
+	if phase < 0.5 {
+		return 4*phase - 1
+	}
+	return 3 - 4*phase
+}
+
+// OscVoice is one layer of a MixOsc: Osc scaled by Weight, with its phase
+// multiplied by Ratio (2 for an octave up). MixOsc.At is given the
+// fundamental's phase already wrapped to [0, 1), so only a whole-number
+// Ratio runs at Ratio times the fundamental frequency; with any other Ratio
+// (0.5, say) the layer's cycle restarts on every cycle of the fundamental.
+type OscVoice struct {
+	Osc    Oscillator
+	Weight float64
+	Ratio  float64
+}
+
+// MixOsc additively combines several oscillators, each at its own
+// frequency ratio and weight. It is purely additive: no layer modulates
+// another layer's phase or frequency.
+type MixOsc struct {
+	Voices []OscVoice
+}
+
+func (m MixOsc) At(phase float64) float64 {
+	var sum float64
+	for _, v := range m.Voices {
+		_, frac := math.Modf(phase * v.Ratio)
+		if frac < 0 {
+			frac++
+		}
+		sum += v.Weight * v.Osc.At(frac)
+	}
+	return sum
+}
@@ -0,0 +1,278 @@
+// Package recorder tees PCM audio into a WAV or AIFF file as it plays. A
+// Writer writes a placeholder header on open, wraps readers passed through
+// Tee so every byte played also lands on disk, and patches the header's
+// size fields once Close is called.
+package recorder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Format selects the container written to disk.
+type Format int
+
+const (
+	FormatWAV Format = iota
+	FormatAIFF
+)
+
+// SampleFormat selects the PCM sample encoding.
+type SampleFormat int
+
+const (
+	SampleInt16 SampleFormat = iota
+	SampleFloat32
+	SampleUint8
+)
+
+func (f SampleFormat) byteLength() int {
+	switch f {
+	case SampleFloat32:
+		return 4
+	case SampleUint8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// wavFormatCode returns the WAVE fmt chunk's format tag: 1 for PCM
+// integers (both uint8 and int16), 3 for IEEE float.
+func (f SampleFormat) wavFormatCode() uint16 {
+	if f == SampleFloat32 {
+		return 3
+	}
+	return 1
+}
+
+// Writer writes a streaming WAV/AIFF file, patching its header sizes on
+// Close. It does no locking of its own: concurrent Writes, Tee'd reads and
+// Close are not synchronized with each other.
+type Writer struct {
+	file         io.WriteSeeker
+	format       Format
+	sampleFormat SampleFormat
+	sampleRate   int
+	channelCount int
+
+	dataStart int64
+	written   int64
+}
+
+// New opens a Writer, writing a placeholder header to file immediately.
+// sampleRate and channelCount must match the audio that will be Tee'd
+// through it.
+func New(file io.WriteSeeker, format Format, sampleFormat SampleFormat, sampleRate, channelCount int) (*Writer, error) {
+	w := &Writer{
+		file:         file,
+		format:       format,
+		sampleFormat: sampleFormat,
+		sampleRate:   sampleRate,
+		channelCount: channelCount,
+	}
+
+	var err error
+	switch format {
+	case FormatWAV:
+		err = w.writeWAVHeader()
+	case FormatAIFF:
+		err = w.writeAIFFHeader()
+	default:
+		return nil, fmt.Errorf("recorder: unknown format: %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends p to the file and counts it towards the header's final
+// size fields.
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Tee wraps src so every byte read from it is also written to the file.
+func (w *Writer) Tee(src io.Reader) io.Reader {
+	return &teeReader{w: w, src: src}
+}
+
+type teeReader struct {
+	w   *Writer
+	src io.Reader
+}
+
+func (t *teeReader) Read(buf []byte) (int, error) {
+	n, err := t.src.Read(buf)
+	if n > 0 {
+		if _, werr := t.w.Write(buf[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (w *Writer) writeWAVHeader() error {
+	byteRate := w.sampleRate * w.channelCount * w.sampleFormat.byteLength()
+	blockAlign := w.channelCount * w.sampleFormat.byteLength()
+
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	// bytes 4:8 (RIFF size) and 40:44 (data size) are placeholders, patched on Close.
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], w.sampleFormat.wavFormatCode())
+	binary.LittleEndian.PutUint16(header[22:24], uint16(w.channelCount))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(w.sampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(byteRate))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:36], uint16(w.sampleFormat.byteLength()*8))
+	copy(header[36:40], "data")
+
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	w.dataStart = 44
+	return nil
+}
+
+func (w *Writer) patchWAVHeader() error {
+	if _, err := w.file.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	var sizes [4]byte
+	binary.LittleEndian.PutUint32(sizes[:], uint32(36+w.written))
+	if _, err := w.file.Write(sizes[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Seek(40, io.SeekStart); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(sizes[:], uint32(w.written))
+	_, err := w.file.Write(sizes[:])
+	return err
+}
+
+// AIFF header layout, all chunk sizes big-endian:
+//
+//	"FORM" size "AIFF" "COMM" size channels frames sampleSize sampleRate(80-bit) "SSND" size offset blockSize
+//	0      4    8      12     16   20       22     26         28                38     42   46     50
+const (
+	aiffNumSampleFramesOffset = 22
+	aiffSSNDSizeOffset        = 42
+)
+
+func (w *Writer) writeAIFFHeader() error {
+	sampleSize := w.sampleFormat.byteLength() * 8
+
+	header := make([]byte, 0, 54)
+	header = append(header, "FORM"...)
+	header = append(header, 0, 0, 0, 0) // FORM size placeholder
+	header = append(header, "AIFF"...)
+
+	header = append(header, "COMM"...)
+	header = appendUint32BE(header, 18)
+	header = appendUint16BE(header, uint16(w.channelCount))
+	header = appendUint32BE(header, 0) // numSampleFrames placeholder
+	header = appendUint16BE(header, uint16(sampleSize))
+	header = append(header, extended80(float64(w.sampleRate))...)
+
+	header = append(header, "SSND"...)
+	header = append(header, 0, 0, 0, 0) // SSND size placeholder
+	header = appendUint32BE(header, 0)  // offset
+	header = appendUint32BE(header, 0)  // blockSize
+
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	w.dataStart = int64(len(header))
+	return nil
+}
+
+func (w *Writer) patchAIFFHeader() error {
+	frameSize := w.channelCount * w.sampleFormat.byteLength()
+	numFrames := uint32(0)
+	if frameSize > 0 {
+		numFrames = uint32(w.written / int64(frameSize))
+	}
+
+	// FORM size: everything after the "FORM" tag and size field itself.
+	if _, err := w.file.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeUint32BE(w.file, uint32(w.dataStart-8+w.written)); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Seek(aiffNumSampleFramesOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeUint32BE(w.file, numFrames); err != nil {
+		return err
+	}
+
+	// SSND chunk size: offset+blockSize fields (8 bytes) plus sample data.
+	if _, err := w.file.Seek(aiffSSNDSizeOffset, io.SeekStart); err != nil {
+		return err
+	}
+	return writeUint32BE(w.file, uint32(8+w.written))
+}
+
+// Close patches the header's size fields with the final byte count. It
+// does not close the underlying file.
+func (w *Writer) Close() error {
+	switch w.format {
+	case FormatWAV:
+		return w.patchWAVHeader()
+	case FormatAIFF:
+		return w.patchAIFFHeader()
+	default:
+		return fmt.Errorf("recorder: unknown format: %d", w.format)
+	}
+}
+
+func appendUint16BE(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32BE(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func writeUint32BE(w io.Writer, v uint32) error {
+	b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	_, err := w.Write(b)
+	return err
+}
+
+// extended80 encodes f as an 80-bit IEEE 754 extended float, the format
+// AIFF's COMM chunk uses for its sample rate field.
+func extended80(f float64) []byte {
+	const bias = 16383
+	bits := make([]byte, 10)
+	if f == 0 {
+		return bits
+	}
+
+	exp := bias
+	for f >= 2 {
+		f /= 2
+		exp++
+	}
+	for f < 1 {
+		f *= 2
+		exp--
+	}
+	f -= 1 // drop the implicit leading 1 bit
+	mantissa := uint64(1)<<63 | uint64(f*(1<<63))
+
+	binary.BigEndian.PutUint16(bits[0:2], uint16(exp))
+	binary.BigEndian.PutUint64(bits[2:10], mantissa)
+	return bits
+}
@@ -0,0 +1,157 @@
+// Package seq plays back a fixed pattern of notes against a
+// keys.AudioContext (or anything else satisfying NoteOnOffer), so a song
+// can be auditioned without a human at the keyboard the whole time.
+package seq
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+)
+
+// NoteOnOffer is the subset of *keys.AudioContext the sequencer drives.
+// FramesPlayed is the Mixer's own playback position, counted in frames
+// actually handed to oto so far; the Sequencer schedules against it
+// instead of wall-clock time, so pattern timing tracks the real audio
+// callback rather than an assumption about how fast time passes.
+type NoteOnOffer interface {
+	NoteOn(freq, velocity float64)
+	NoteOff(freq float64)
+	FramesPlayed() int64
+}
+
+// Step is one slot in a Pattern. NoteNumber is a MIDI note number, the
+// same numbering keys.KeyNoteNumbers and the midi package use; a Rest
+// step is silent. GateLen is the fraction of the step's duration the note
+// is held for before NoteOff, in (0, 1]; it defaults to 1 (the full step)
+// if zero.
+type Step struct {
+	NoteNumber int     `json:"note"`
+	Velocity   float64 `json:"velocity"`
+	GateLen    float64 `json:"gate"`
+	Rest       bool    `json:"rest"`
+}
+
+// Pattern is an ordered, looping sequence of Steps, one per beat
+// subdivision (see Sequencer.Start).
+type Pattern []Step
+
+// LoadPattern reads a Pattern from a JSON file: a top-level array of Step
+// objects, e.g. [{"note": 60, "velocity": 0.8, "gate": 0.5}, {"rest": true}].
+func LoadPattern(path string) (Pattern, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Pattern
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// stepsPerBeat is the subdivision every Step represents: one sixteenth
+// note. This matches the resolution most simple step sequencers use.
+const stepsPerBeat = 4
+
+// pollInterval is how often Sequencer checks NoteOnOffer.FramesPlayed
+// against the next scheduled frame. It only paces the polling loop; the
+// decision of when a step or note-off actually fires is made entirely
+// from FramesPlayed, not from how long the sleep took.
+const pollInterval = time.Millisecond
+
+// Sequencer steps through a Pattern at a given tempo, calling NoteOn and
+// NoteOff on target as it goes. Step and gate boundaries are expressed in
+// frames (derived from sampleRate and bpm) and fired once target's own
+// FramesPlayed reaches them, so timing tracks the Mixer's real playback
+// position rather than the wall clock.
+type Sequencer struct {
+	pattern    Pattern
+	target     NoteOnOffer
+	sampleRate int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSequencer creates a Sequencer that plays pattern against target.
+// sampleRate should match the AudioContext target is backed by.
+func NewSequencer(pattern Pattern, target NoteOnOffer, sampleRate int) *Sequencer {
+	return &Sequencer{pattern: pattern, target: target, sampleRate: sampleRate}
+}
+
+// Start begins stepping through the pattern at bpm beats per minute,
+// looping forever until Stop is called. It returns immediately; playback
+// happens on its own goroutine.
+func (s *Sequencer) Start(bpm float64) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	stepFrames := int64(float64(s.sampleRate) * 60 / bpm / stepsPerBeat)
+
+	go func() {
+		defer close(s.done)
+
+		if len(s.pattern) == 0 {
+			return
+		}
+
+		nextStepAt := s.target.FramesPlayed()
+		for i := 0; ; i = (i + 1) % len(s.pattern) {
+			if !s.waitUntilFrame(nextStepAt) {
+				return
+			}
+
+			step := s.pattern[i]
+			if !step.Rest {
+				freq := noteNumberToFreq(step.NoteNumber)
+				gate := step.GateLen
+				if gate <= 0 {
+					gate = 1
+				}
+				gateEndsAt := nextStepAt + int64(float64(stepFrames)*gate)
+
+				s.target.NoteOn(freq, step.Velocity)
+				go func() {
+					if s.waitUntilFrame(gateEndsAt) {
+						s.target.NoteOff(freq)
+					}
+				}()
+			}
+
+			nextStepAt += stepFrames
+		}
+	}()
+}
+
+// waitUntilFrame blocks until target.FramesPlayed reaches frame, or Stop
+// is called, in which case it returns false.
+func (s *Sequencer) waitUntilFrame(frame int64) bool {
+	for s.target.FramesPlayed() < frame {
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(pollInterval):
+		}
+	}
+	return true
+}
+
+// Stop ends playback and waits for the sequencer's goroutine to exit. It
+// is a no-op if Start was never called.
+func (s *Sequencer) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// noteNumberToFreq converts a MIDI note number to its frequency in Hz,
+// using A4 (note 69) as 440Hz. Duplicated from keys.NoteNumberToFreq to
+// avoid this package depending on keys for one formula.
+func noteNumberToFreq(noteNumber int) float64 {
+	return 440 * math.Pow(2, float64(noteNumber-69)/12)
+}
@@ -1,19 +1,108 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"time"
+
 	"keyboard/keys"
+	"keyboard/keys/midi"
+	"keyboard/keys/seq"
 
 	"github.com/eiannone/keyboard"
 )
 
+var (
+	input      = flag.String("input", "keyboard", "event source (keyboard or midi)")
+	midiDevice = flag.Int("midi-device", 0, "midi input device id, see keys/midi.Devices")
+	record     = flag.String("record", "", "record everything played to this WAV file")
+	wave       = flag.String("wave", "sine", "oscillator waveform (sine, square, saw, or triangle)")
+	pattern    = flag.String("pattern", "", "play this JSON pattern file through the sequencer, see keys/seq.LoadPattern")
+	bpm        = flag.Float64("bpm", 120, "sequencer tempo in beats per minute")
+)
+
 func main() {
-	c, op, err := keys.InitAudioContext()
+	flag.Parse()
+
+	a, err := keys.InitAudioContext()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	osc, err := oscillator(*wave)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	a.SetOscillator(osc)
+
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		if err := a.RecordTo(f); err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer func() {
+			if err := a.StopRecording(); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
 
+	if *pattern != "" {
+		p, err := seq.LoadPattern(*pattern)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		s := seq.NewSequencer(p, a, a.SampleRate())
+		s.Start(*bpm)
+		defer s.Stop()
+	}
+
+	switch *input {
+	case "keyboard":
+		runKeyboard(a)
+	case "midi":
+		if err := runMIDI(a); err != nil {
+			fmt.Println(err)
+		}
+	default:
+		fmt.Printf("input must be keyboard or midi but: %s\n", *input)
+	}
+}
+
+// oscillator maps the -wave flag's name to a keys.Oscillator.
+func oscillator(name string) (keys.Oscillator, error) {
+	switch name {
+	case "sine":
+		return keys.SineOsc{}, nil
+	case "square":
+		return keys.SquareOsc{}, nil
+	case "saw":
+		return keys.SawOsc{}, nil
+	case "triangle":
+		return keys.TriangleOsc{}, nil
+	default:
+		return nil, fmt.Errorf("wave must be sine, square, saw, or triangle but: %s", name)
+	}
+}
+
+// runKeyboard reads the terminal QWERTY layout and plays notes through a's
+// Mixer. The keyboard has no key-up event, so a held key is simulated by
+// releasing it once DefaultEnvelope's Sustain window elapses.
+func runKeyboard(a *keys.AudioContext) {
 	keysEvents, err := keyboard.GetKeys(200)
 	if err != nil {
 		fmt.Println(err)
@@ -25,23 +114,47 @@ func main() {
 
 	fmt.Println("Press ESC to quit")
 	for {
-		select {
-		case event := <-keysEvents:
-			keys.NoteCount++
-			if event.Err != nil {
-				panic(event.Err)
-			}
+		event := <-keysEvents
+		if event.Err != nil {
+			panic(event.Err)
+		}
 
-			fmt.Printf("You pressed: %q\n", event.Rune)
-			if event.Key == keyboard.KeyEsc {
-				return
-			}
+		fmt.Printf("You pressed: %q\n", event.Rune)
+		if event.Key == keyboard.KeyEsc {
+			return
+		}
 
-			go func(key rune) {
-				if err := keys.Run(key, c, op); err != nil {
-					panic(err)
-				}
-			}(event.Rune)
+		note, ok := keys.KeyNoteNumbers[string(event.Rune)]
+		if !ok {
+			continue
 		}
+
+		freq := keys.NoteNumberToFreq(note)
+		a.NoteOn(freq, 1)
+		time.AfterFunc(keys.DefaultEnvelope.Sustain, func() { a.NoteOff(freq) })
+	}
+}
+
+// runMIDI reads note-on/note-off events from a MIDI input device and plays
+// them with real velocity and polyphony on the same Mixer the keyboard
+// source uses.
+func runMIDI(a *keys.AudioContext) error {
+	src, events, err := midi.Open(*midiDevice)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	fmt.Println("Listening for MIDI input, Ctrl+C to quit")
+	for event := range events {
+		freq := keys.NoteNumberToFreq(event.Note)
+		a.NoteOn(freq, event.Velocity)
+		go func(gate <-chan struct{}) {
+			<-gate
+			a.NoteOff(freq)
+		}(event.Gate)
 	}
+	return nil
 }